@@ -0,0 +1,54 @@
+// Copyright 2017 Péter Szakszon. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mux
+
+import (
+	"net"
+	"strings"
+
+	"github.com/szxp/mux/internal/tree"
+)
+
+// parseHostSegments splits a host pattern into tree.Segments, most
+// general label first, so that "api.example.com" and "admin.example.com"
+// share the "com"/"example" prefix of the host tree the same way two
+// paths share a static prefix. It recognizes the ":name" dynamic form
+// and the "*" wildcard, which matches exactly one label without binding
+// it.
+func parseHostSegments(host string) []tree.Segment {
+	labels := strings.Split(host, ".")
+	segments := make([]tree.Segment, len(labels))
+	for i, label := range labels {
+		switch {
+		case label == "*":
+			segments[i] = tree.Segment{Kind: tree.Dynamic}
+		case len(label) > 0 && label[0] == ':':
+			segments[i] = tree.Segment{Kind: tree.Dynamic, Text: label[1:]}
+		default:
+			segments[i] = tree.Segment{Kind: tree.Static, Text: label}
+		}
+	}
+	reverse(segments)
+	return segments
+}
+
+// hostLabels splits a request's Host header into the labels the host
+// tree's Lookup expects, stripping a port if present and reversing the order
+// to match parseHostSegments.
+func hostLabels(host string) []string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	labels := strings.Split(host, ".")
+	reverse(labels)
+	return labels
+}
+
+func reverse[T any](s []T) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
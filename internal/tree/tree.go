@@ -0,0 +1,369 @@
+// Copyright 2017 Péter Szakszon. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tree implements the compressed radix tree used internally by
+// Muxer to store routes and match request paths in time proportional to
+// the path length rather than the number of registered routes.
+package tree
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Leaf holds the handlers registered for the exact path reached by
+// following a pattern's segments down the tree. Slash holds handlers
+// for patterns whose pattern ends in "/"; NonSlash holds handlers for
+// patterns that don't. Both are keyed by HTTP method, with the empty
+// string key meaning "any method".
+type Leaf struct {
+	Slash    map[string]interface{}
+	NonSlash map[string]interface{}
+
+	// SlashPattern and NonSlashPattern hold the original pattern text
+	// registered for Slash and NonSlash respectively, for Walk to
+	// report. A single leaf can hold both, since "/users" and "/users/"
+	// trim to the same segments but keep their handlers in different
+	// maps.
+	SlashPattern    string
+	NonSlashPattern string
+}
+
+func newLeaf() *Leaf {
+	return &Leaf{
+		Slash:    make(map[string]interface{}),
+		NonSlash: make(map[string]interface{}),
+	}
+}
+
+// node is one node of the tree. It holds its static children in a map
+// keyed by segment text, plus at most one dynamic (":name") child and
+// one catch-all ("*name") child.
+type node struct {
+	static       map[string]*node
+	param        *node
+	paramName    string
+	paramRegex   *regexp.Regexp
+	paramConvert Convert
+	catchAll     *node
+	catchAllName string
+	leaf         *Leaf
+}
+
+// SegmentKind identifies how a Segment passed to Insert is matched.
+type SegmentKind byte
+
+const (
+	// Static matches a path segment by exact text equality.
+	Static SegmentKind = iota
+	// Dynamic matches any single path segment, optionally constrained
+	// by Regex, and binds it to Name.
+	Dynamic
+	// CatchAll matches and joins every remaining path segment, binding
+	// the result to Name. It must be the last segment of a pattern.
+	CatchAll
+)
+
+// Convert turns the raw text of a matched Dynamic segment into a typed
+// value to place in Params, e.g. a decimal string into an int.
+type Convert func(string) (interface{}, error)
+
+// Segment describes one element of a pattern passed to Insert.
+type Segment struct {
+	// Text is the literal text for a Static segment, or the param name
+	// for a Dynamic or CatchAll segment.
+	Text string
+
+	Kind SegmentKind
+
+	// Regex, if non-nil, must match a candidate path segment in full
+	// for a Dynamic segment to bind it. Ignored for other kinds.
+	Regex *regexp.Regexp
+
+	// Convert, if non-nil, produces the typed value bound into Params
+	// for a Dynamic segment. Ignored for other kinds.
+	Convert Convert
+}
+
+// child returns the child of n for segment s, creating it if
+// necessary.
+//
+// A node has only one dynamic and one catch-all slot, shared by every
+// pattern that reaches that position in the tree, so a second Insert
+// through the same slot with a different name, regex or convert would
+// otherwise silently overwrite the first route's binding. Text == ""
+// (the host wildcard label "*" or a bare "*" catch-all) is the one
+// deliberately anonymous case and never conflicts with a named
+// registration sharing the slot; anything else must match exactly,
+// or child panics rather than corrupting an already-registered route.
+func (n *node) child(s Segment) *node {
+	switch s.Kind {
+	case Dynamic:
+		if n.param == nil {
+			n.param = &node{}
+			n.paramName = s.Text
+			n.paramRegex = s.Regex
+			n.paramConvert = s.Convert
+		} else if s.Text != "" {
+			if n.paramName == "" {
+				n.paramName = s.Text
+				n.paramRegex = s.Regex
+				n.paramConvert = s.Convert
+			} else if n.paramName != s.Text || !sameRegex(n.paramRegex, s.Regex) || !sameConvert(n.paramConvert, s.Convert) {
+				panic("mux: conflicting dynamic segments registered at the same position: :" + n.paramName + " vs :" + s.Text)
+			}
+		}
+		return n.param
+	case CatchAll:
+		if n.catchAll == nil {
+			n.catchAll = &node{}
+			n.catchAllName = s.Text
+		} else if s.Text != "" {
+			if n.catchAllName == "" {
+				n.catchAllName = s.Text
+			} else if n.catchAllName != s.Text {
+				panic("mux: conflicting catch-all segments registered at the same position: *" + n.catchAllName + " vs *" + s.Text)
+			}
+		}
+		return n.catchAll
+	default:
+		if n.static == nil {
+			n.static = make(map[string]*node)
+		}
+		c, ok := n.static[s.Text]
+		if !ok {
+			c = &node{}
+			n.static[s.Text] = c
+		}
+		return c
+	}
+}
+
+// sameRegex reports whether a and b constrain a Dynamic segment the
+// same way. *regexp.Regexp values are recompiled from the pattern text
+// on every table rebuild (see routingTable.apply), so they must be
+// compared by their source pattern, not by pointer identity.
+func sameRegex(a, b *regexp.Regexp) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.String() == b.String()
+}
+
+// sameConvert reports whether a and b are the same conversion
+// function. Shortcuts like "int" and "uuid" are looked up from a
+// shared package-level table, so the same shortcut always yields the
+// same underlying function value across rebuilds.
+func sameConvert(a, b Convert) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// Tree is a compressed radix tree of URL path segments.
+type Tree struct {
+	root *node
+}
+
+// New returns an empty Tree.
+func New() *Tree {
+	return &Tree{root: &node{}}
+}
+
+// Insert returns the Leaf for the given pattern segments, creating
+// intermediate nodes as necessary.
+func (t *Tree) Insert(segments []Segment) *Leaf {
+	n := t.root
+	for _, s := range segments {
+		n = n.child(s)
+	}
+	if n.leaf == nil {
+		n.leaf = newLeaf()
+	}
+	return n.leaf
+}
+
+// Candidate is a possible match for a looked-up path.
+type Candidate struct {
+	// Leaf is the matched node's handlers.
+	Leaf *Leaf
+
+	// Params holds the param values bound while descending to Leaf. A
+	// Dynamic segment registered with a Convert function stores its
+	// converted, typed value here instead of the raw path text.
+	Params map[string]interface{}
+
+	// Prefix reports whether Leaf sits above the full path depth, i.e.
+	// it was reached by a pattern shorter than the request path that
+	// acts as a catch-all for everything beneath it (the legacy
+	// "r.len < slen" rule for patterns registered with a trailing
+	// slash).
+	Prefix bool
+
+	priority uint64
+}
+
+// Priority codes packed two bits per path position into a Candidate's
+// priority, most significant position first: unset (0) sorts lowest,
+// so a candidate that matched fewer segments never outranks one that
+// matched more at the same position, same as comparing the former
+// per-position byte strings lexicographically. Two bits per position
+// caps fine-grained ordering at 32 path segments, far beyond any real
+// route; Lookup still returns correct matches past that depth, but only
+// the last 32 positions of the path are ranked: priority among the
+// leading positions before them is not distinguished.
+const (
+	priorityCatchAll uint64 = 1
+	priorityDynamic  uint64 = 2
+	priorityStatic   uint64 = 3
+)
+
+// binding is one param name bound while descending toward a Candidate.
+type binding struct {
+	name  string
+	value interface{}
+}
+
+// paramsMap turns bindings into the map a Candidate exposes, or nil if
+// there were none, so a purely static lookup never touches the heap
+// for params.
+func paramsMap(bindings []binding) map[string]interface{} {
+	if len(bindings) == 0 {
+		return nil
+	}
+	m := make(map[string]interface{}, len(bindings))
+	for _, b := range bindings {
+		m[b.name] = b.value
+	}
+	return m
+}
+
+// bind appends name/value to bindings, sizing the first allocation to
+// sizeHint so a path with several dynamic segments doesn't pay for the
+// slice growing one element at a time.
+func bind(bindings []binding, sizeHint int, name string, value interface{}) []binding {
+	if bindings == nil {
+		bindings = make([]binding, 0, sizeHint)
+	}
+	return append(bindings, binding{name, value})
+}
+
+// Lookup returns every Leaf that could serve the given path segments,
+// ordered the same way the former linear scan's byPriority did: a
+// longer static prefix wins, and a static segment always beats a
+// dynamic one at the same position. Descending the tree only explores
+// the branches that can possibly match, so lookup cost is independent
+// of the number of registered routes.
+func (t *Tree) Lookup(segments []string) []Candidate {
+	slen := len(segments)
+	var out []Candidate
+
+	// bindings starts nil and is only allocated by append once the
+	// first Dynamic segment actually binds, so a purely static lookup
+	// never touches the heap for it; from then on it's reused across
+	// sibling branches by slicing on length, the same backtracking
+	// trick the stdlib radix-tree routers use. A branch that doesn't
+	// reach a Leaf never builds a map, and one that does pays for
+	// exactly one, built once in paramsMap, instead of once per
+	// descended segment.
+	var walk func(n *node, i int, pri uint64, bindings []binding)
+	walk = func(n *node, i int, pri uint64, bindings []binding) {
+		if n.leaf != nil {
+			if i == slen {
+				out = append(out, Candidate{
+					Leaf:     n.leaf,
+					Params:   paramsMap(bindings),
+					priority: pri,
+				})
+			} else if len(n.leaf.Slash) > 0 {
+				out = append(out, Candidate{
+					Leaf:     n.leaf,
+					Params:   paramsMap(bindings),
+					Prefix:   true,
+					priority: pri,
+				})
+			}
+		}
+		if i == slen {
+			return
+		}
+
+		shift := 2 * uint(slen-1-i)
+		seg := segments[i]
+		if c, ok := n.static[seg]; ok {
+			walk(c, i+1, pri|(priorityStatic<<shift), bindings)
+		}
+		if n.param != nil && (n.paramRegex == nil || n.paramRegex.MatchString(seg)) {
+			value, ok := convertParam(n.paramConvert, seg)
+			if ok {
+				walk(n.param, i+1, pri|(priorityDynamic<<shift), bind(bindings, slen-i, n.paramName, value))
+			}
+		}
+		if n.catchAll != nil && n.catchAll.leaf != nil {
+			out = append(out, Candidate{
+				Leaf:     n.catchAll.leaf,
+				Params:   paramsMap(bind(bindings, slen-i, n.catchAllName, strings.Join(segments[i:], "/"))),
+				priority: pri | (priorityCatchAll << shift),
+			})
+		}
+	}
+	walk(t.root, 0, 0, nil)
+
+	// Insertion sort, not sort.SliceStable: out holds at most one entry
+	// per pattern that could still match this path, so it's small, and
+	// a request almost always resolves to zero or one candidate, where
+	// the loop below is a no-op. sort.SliceStable pays for a
+	// reflection-driven swapper on every call regardless of length;
+	// this doesn't allocate at all.
+	for i := 1; i < len(out); i++ {
+		c := out[i]
+		j := i - 1
+		for j >= 0 && out[j].priority < c.priority {
+			out[j+1] = out[j]
+			j--
+		}
+		out[j+1] = c
+	}
+	return out
+}
+
+// Walk calls fn for every leaf in the tree, stopping early if fn
+// returns false. The traversal order is unspecified.
+func (t *Tree) Walk(fn func(leaf *Leaf) bool) {
+	var walk func(n *node) bool
+	walk = func(n *node) bool {
+		if n.leaf != nil && !fn(n.leaf) {
+			return false
+		}
+		for _, c := range n.static {
+			if !walk(c) {
+				return false
+			}
+		}
+		if n.param != nil && !walk(n.param) {
+			return false
+		}
+		if n.catchAll != nil && !walk(n.catchAll) {
+			return false
+		}
+		return true
+	}
+	walk(t.root)
+}
+
+// convertParam applies convert to seg, if given. A conversion error
+// means seg satisfied the segment's Regex but not its stricter typed
+// format, so the branch is not a match.
+func convertParam(convert Convert, seg string) (interface{}, bool) {
+	if convert == nil {
+		return seg, true
+	}
+	v, err := convert(seg)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
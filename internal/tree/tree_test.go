@@ -0,0 +1,214 @@
+package tree
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// segs splits a request path into the plain segments Lookup expects.
+func segs(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// pattern splits a pattern into the Segments Insert expects, using the
+// ":name" / "*name" shorthand for dynamic and catch-all segments.
+func pattern(p string) []Segment {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	out := make([]Segment, len(parts))
+	for i, s := range parts {
+		switch {
+		case len(s) > 0 && s[0] == ':':
+			out[i] = Segment{Kind: Dynamic, Text: s[1:]}
+		case len(s) > 0 && s[0] == '*':
+			out[i] = Segment{Kind: CatchAll, Text: s[1:]}
+		default:
+			out[i] = Segment{Kind: Static, Text: s}
+		}
+	}
+	return out
+}
+
+func TestStaticLookup(t *testing.T) {
+	tr := New()
+	tr.Insert(pattern("/users/admin")).NonSlash[""] = "admin"
+
+	cands := tr.Lookup(segs("/users/admin"))
+	if len(cands) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(cands))
+	}
+	if cands[0].Leaf.NonSlash[""] != "admin" {
+		t.Fatalf("unexpected leaf: %v", cands[0].Leaf)
+	}
+	if cands[0].Prefix {
+		t.Fatal("expected an exact match, not a prefix match")
+	}
+
+	if cands := tr.Lookup(segs("/users/other")); len(cands) != 0 {
+		t.Fatalf("expected no candidates, got %d", len(cands))
+	}
+}
+
+func TestDynamicLookupBindsParams(t *testing.T) {
+	tr := New()
+	tr.Insert(pattern("/:deckId/study/:cardId")).NonSlash[""] = "deck"
+
+	cands := tr.Lookup(segs("/123/study/99"))
+	if len(cands) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(cands))
+	}
+	params := cands[0].Params
+	if params["deckId"] != "123" || params["cardId"] != "99" {
+		t.Fatalf("unexpected params: %v", params)
+	}
+}
+
+func TestStaticBeatsDynamic(t *testing.T) {
+	tr := New()
+	tr.Insert(pattern("/a/second")).NonSlash[""] = "static"
+	tr.Insert(pattern("/:x/second")).NonSlash[""] = "dynamic"
+
+	cands := tr.Lookup(segs("/a/second"))
+	if len(cands) < 1 || cands[0].Leaf.NonSlash[""] != "static" {
+		t.Fatalf("expected the static route to be tried first, got %v", cands)
+	}
+}
+
+func TestSlashActsAsPrefixCatchAll(t *testing.T) {
+	tr := New()
+	tr.Insert(pattern("/users/")).Slash[""] = "users"
+	tr.Insert(pattern("/users/admin")).NonSlash[""] = "admin"
+
+	cands := tr.Lookup(segs("/users/administrator"))
+	if len(cands) != 1 || !cands[0].Prefix || cands[0].Leaf.Slash[""] != "users" {
+		t.Fatalf("expected the shorter /users/ route to catch this path, got %v", cands)
+	}
+}
+
+func TestCatchAll(t *testing.T) {
+	tr := New()
+	tr.Insert(pattern("/static/*path")).NonSlash[""] = "assets"
+
+	cands := tr.Lookup(segs("/static/css/site.css"))
+	if len(cands) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(cands))
+	}
+	if cands[0].Params["path"] != "css/site.css" {
+		t.Fatalf("unexpected catch-all binding: %v", cands[0].Params)
+	}
+}
+
+func TestDynamicRegexConstraint(t *testing.T) {
+	tr := New()
+	segments := pattern("/users/:id")
+	segments[1].Regex = regexp.MustCompile(`^\d+$`)
+	tr.Insert(segments).NonSlash[""] = "user"
+
+	if cands := tr.Lookup(segs("/users/42")); len(cands) != 1 {
+		t.Fatalf("expected the numeric id to match, got %v", cands)
+	}
+	if cands := tr.Lookup(segs("/users/abc")); len(cands) != 0 {
+		t.Fatalf("expected the non-numeric id to be rejected, got %v", cands)
+	}
+}
+
+func TestDynamicConvert(t *testing.T) {
+	tr := New()
+	segments := pattern("/users/:id")
+	segments[1].Regex = regexp.MustCompile(`^\d+$`)
+	segments[1].Convert = func(s string) (interface{}, error) {
+		return strconv.Atoi(s)
+	}
+	tr.Insert(segments).NonSlash[""] = "user"
+
+	cands := tr.Lookup(segs("/users/42"))
+	if len(cands) != 1 {
+		t.Fatalf("expected a match, got %v", cands)
+	}
+	id, ok := cands[0].Params["id"].(int)
+	if !ok || id != 42 {
+		t.Fatalf("expected id to be the int 42, got %#v", cands[0].Params["id"])
+	}
+}
+
+func TestDynamicConvertErrorRejectsBranch(t *testing.T) {
+	tr := New()
+	segments := pattern("/users/:id")
+	segments[1].Convert = func(s string) (interface{}, error) {
+		return nil, errors.New("always fails")
+	}
+	tr.Insert(segments).NonSlash[""] = "user"
+
+	if cands := tr.Lookup(segs("/users/42")); len(cands) != 0 {
+		t.Fatalf("expected the failed conversion to reject the match, got %v", cands)
+	}
+}
+
+func TestConflictingDynamicNamePanics(t *testing.T) {
+	tr := New()
+	tr.Insert(pattern("/users/:id")).NonSlash[""] = "by id"
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected Insert to panic on a conflicting dynamic segment")
+		}
+	}()
+	tr.Insert(pattern("/users/:slug"))
+}
+
+func TestConflictingDynamicRegexPanics(t *testing.T) {
+	tr := New()
+	tr.Insert(pattern("/users/:id")).NonSlash[""] = "by id"
+
+	constrained := pattern("/users/:id")
+	constrained[1].Regex = regexp.MustCompile(`^[a-z]+$`)
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected Insert to panic on a conflicting regex constraint")
+		}
+	}()
+	tr.Insert(constrained)
+}
+
+func TestAnonymousDynamicDoesNotConflictWithNamed(t *testing.T) {
+	tr := New()
+	tr.Insert(pattern("/:tenant/dashboard")).NonSlash[""] = "dashboard"
+
+	// An anonymous Dynamic segment (the host "*" wildcard) shares the
+	// same tree position without renaming or otherwise disturbing the
+	// already-bound "tenant" param.
+	anonymous := pattern("/:x/other")
+	anonymous[0].Text = ""
+	tr.Insert(anonymous).NonSlash[""] = "other"
+
+	cands := tr.Lookup(segs("/acme/dashboard"))
+	if len(cands) != 1 {
+		t.Fatalf("expected 1 candidate, got %v", cands)
+	}
+	if cands[0].Params["tenant"] != "acme" {
+		t.Fatalf("expected tenant to still bind to acme, got %#v", cands[0].Params)
+	}
+}
+
+func TestRepeatedIdenticalRegexDoesNotConflict(t *testing.T) {
+	tr := New()
+	segments := pattern("/users/:id")
+	segments[1].Regex = regexp.MustCompile(`^\d+$`)
+	tr.Insert(segments).NonSlash["GET"] = "get"
+
+	// A second Insert of the identical pattern text (as happens on
+	// every table rebuild, since the regex is recompiled from scratch
+	// each time) must not be treated as a conflict just because the
+	// *regexp.Regexp values differ by pointer.
+	segments2 := pattern("/users/:id")
+	segments2[1].Regex = regexp.MustCompile(`^\d+$`)
+	tr.Insert(segments2).NonSlash["POST"] = "post"
+
+	cands := tr.Lookup(segs("/users/42"))
+	if len(cands) != 1 {
+		t.Fatalf("expected 1 candidate, got %v", cands)
+	}
+}
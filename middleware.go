@@ -0,0 +1,73 @@
+// Copyright 2017 Péter Szakszon. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mux
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Logger returns a middleware that logs the method, path, status code
+// and duration of every request it handles.
+//
+//	muxer := mux.NewMuxer()
+//	muxer.Use(mux.Logger(log.Default()))
+func Logger(logger *log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			logger.Printf("%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(started))
+		})
+	}
+}
+
+// statusRecorder captures the status code written by the wrapped
+// handler so Logger can report it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// CORS returns a middleware that answers CORS preflight (OPTIONS)
+// requests and adds the Access-Control-Allow-Origin header to every
+// response for the given origins. Pass "*" to allow any origin.
+//
+//	muxer := mux.NewMuxer()
+//	muxer.Use(mux.CORS("https://example.com"))
+func CORS(origins ...string) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[o] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin != "" && (allowed["*"] || allowed[origin]) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Vary", "Origin")
+			}
+
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
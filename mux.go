@@ -9,111 +9,47 @@ import (
 	"context"
 	"net/http"
 	"path"
-	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // Muxer represents an HTTP request multiplexer.
 type Muxer struct {
-	mu              sync.RWMutex
-	registered      map[string]*route
-	routes          []*route
-	notFoundHandler func(w http.ResponseWriter, r *http.Request, methodMismatch bool)
-}
+	state *muxerState
 
-// NewMuxer returns a new Muxer.
-// The returned Muxer is safe for concurrent use by multiple goroutines.
-func NewMuxer() *Muxer {
-	return &Muxer{
-		registered: make(map[string]*route, 10),
-		routes:     make([]*route, 0, 10),
-	}
+	// hostPrefix is the host a Muxer returned by Host registers
+	// patterns under. It is empty for a Muxer returned by NewMuxer.
+	// Handle prepends it to every pattern, so it both scopes the route
+	// to that host and appears in the pattern text reported by Walk.
+	hostPrefix string
 }
 
-// route represents a pattern with handlers.
-type route struct {
-	// the exploded pattern
-	segments []string
-
-	// the length of segments slice
-	len int
-
-	// supported method
-	method string
-
-	// paramateres names: segment index -> name
-	params map[int]string
-
-	// the handler for a pattern that ends in a slash
-	slashHandler http.Handler
-
-	// the handler for a pattern that NOT ends in a slash
-	nonSlashHandler http.Handler
+// muxerState is the mutable state shared by a Muxer and every Muxer
+// derived from it through Host. mu serializes writers; table is the
+// published snapshot ServeHTTP reads lock-free. registrations and
+// middlewareFns are replayed into a fresh table on every write so the
+// table itself never needs mutating in place.
+type muxerState struct {
+	mu            sync.Mutex
+	table         atomic.Pointer[routingTable]
+	registrations []registration
+	middlewareFns []func(http.Handler) http.Handler
+	notFoundFn    func(w http.ResponseWriter, r *http.Request, methodMismatch bool)
 }
 
-// methodSupported checks whether the given method
-// is supported by this route.
-func (p *route) methodSupported(method string) bool {
-	return p.method == "" || p.method == method
-}
-
-// notMatch checks whether the segment at index i
-// does not match the pathSeg path segment.
-func (p *route) notMatch(pathSeg string, i int) bool {
-	if /*p.len == 0 || */ p.len-1 < i {
-		return false
-	}
-
-	s := p.segments[i]
-	return (len(s) == 0 || s[0] != ':') && (s != pathSeg)
-}
-
-// args is a map for request parameter values.
-type args map[string]string
-
-// argsMap returns a map containing request parameter values.
-func (p *route) argsMap(pathSegs []string) args {
-	m := args{}
-	slen := len(pathSegs)
-	for i, name := range p.params {
-		if i < slen {
-			m[name] = pathSegs[i]
-		}
-	}
-	return m
-}
-
-// priority computes the priority of the route.
-//
-// Every segment has a priority value:
-// 2 = static segment
-// 1 = dynamic segment
-//
-// The route priority is created by concatenating the priorities of the segments.
-// The slash (/) route has the priority 0.
-func (p *route) priority() string {
-	if p.segments[0] == "" { // slash pattern
-		return "0"
-	}
-	pri := make([]byte, 0, 3)
-	for _, s := range p.segments {
-		if s[0] == ':' {
-			pri = append(pri, '1')
-		} else {
-			pri = append(pri, '2')
-		}
-	}
-	return string(pri)
+// NewMuxer returns a new Muxer.
+// The returned Muxer is safe for concurrent use by multiple goroutines.
+func NewMuxer() *Muxer {
+	s := &muxerState{}
+	s.table.Store(newRoutingTable())
+	return &Muxer{state: s}
 }
 
-// byPriority implements sort.Interface for []*route based on
-// the priority().
-type byPriority []*route
-
-func (a byPriority) Len() int           { return len(a) }
-func (a byPriority) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byPriority) Less(i, j int) bool { return a[i].priority() > a[j].priority() }
+// args is a map for request parameter values. Values are usually
+// strings, but a typed pattern shortcut such as "{id:int}" binds an
+// already-converted value instead (see parseSegment).
+type args map[string]interface{}
 
 // Handle registers the handler for the given pattern.
 //
@@ -128,11 +64,34 @@ func (a byPriority) Less(i, j int) bool { return a[i].priority() > a[j].priority
 //   /blog/:year/:month
 //   /users/:username/profile
 //
+// A dynamic segment can be constrained to a regular expression, either
+// inline or through a named shortcut:
+//   /users/:id(\d+)
+//   /users/{id:int}
+//   /orders/{id:uuid}
+//   /posts/{slug:[a-z0-9-]+}
+// A request whose segment doesn't satisfy the constraint is treated as
+// not matching the pattern. The "int" and "uuid" shortcuts also bind an
+// already-parsed int or mux.UUID into the context instead of the raw
+// string; every other form binds a string, same as a plain ":name".
+//
 // Parameter values for a dynamic pattern will be available
 // in the request's context (http.Request.Context()) associated with
 // the parameter name. Use the context's Value() method to retrieve a value:
 //   value := req.Context().Value(mux.CtxKey("username")))
 //
+// A pattern may be prefixed with a host to scope it to requests whose
+// Host header matches, e.g.:
+//   api.example.com/v1/users/:id
+// A pattern without a host prefix matches regardless of the Host header.
+// The host itself can contain ":name" and "*" dynamic labels, matching
+// exactly one label each; "*" is not bound into the context, but
+// ":name" is, same as a path parameter:
+//   :tenant.example.com/dashboard
+//   *.example.com/
+// See also the Host method, which registers patterns under a host
+// without repeating it in every call.
+//
 // The muxer will choose the most specific pattern that matches the request.
 // A pattern with longer static prefix is more specific
 // than a pattern with a shorter static prefix.
@@ -153,52 +112,49 @@ func (a byPriority) Less(i, j int) bool { return a[i].priority() > a[j].priority
 // with "404 Not found" or "405 Method not allowed" status code.
 // Use the NotFound method to set a custom error handler.
 func (m *Muxer) Handle(pattern string, handler http.Handler, methods ...string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	if pattern == "" {
 		panic("invalid pattern " + pattern)
 	}
-
-	host, path := split(pattern)
-	endsInSlash := path[len(path)-1] == '/'
-	path = strings.Trim(path, "/")
-
 	if len(methods) == 0 {
 		methods = []string{""}
 	}
-	for _, method := range methods {
-		key := method + host + path
-		r := m.registered[key]
-		if r == nil {
-			r = newRoute(method, path)
-			m.routes = append(m.routes, r)
-			m.registered[key] = r
-		}
 
-		if endsInSlash {
-			r.slashHandler = handler
-		} else {
-			r.nonSlashHandler = handler
+	s := m.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registrations = append(s.registrations, registration{
+		pattern: m.hostPrefix + pattern,
+		handler: handler,
+		methods: methods,
+	})
+	// A malformed or conflicting pattern makes publishLocked panic;
+	// drop the registration again so later rebuilds don't replay it.
+	defer func() {
+		if r := recover(); r != nil {
+			s.registrations = s.registrations[:len(s.registrations)-1]
+			panic(r)
 		}
-	}
-	sort.Sort(byPriority(m.routes))
+	}()
+	s.publishLocked()
 }
 
-func newRoute(method, path string) *route {
-	r := &route{method: method}
-	r.segments = strings.Split(path, "/")
-	r.len = len(r.segments)
-
-	for i, s := range r.segments {
-		if len(s) > 0 && s[0] == ':' { // dynamic segment
-			if r.params == nil {
-				r.params = make(map[int]string)
-			}
-			r.params[i] = s[1:]
-		}
-	}
-	return r
+// publishLocked rebuilds a routingTable from scratch by replaying every
+// registration and publishes it with a single atomic store. The
+// caller must hold s.mu.
+//
+// Replaying from scratch makes N calls to Handle/Use/NotFound during
+// startup O(N^2) overall, trading it for ServeHTTP never taking a lock
+// or seeing a table that's only partway rebuilt. That's the right
+// trade for this package's use case: routes are registered once at
+// startup and read on every request thereafter, so the O(N^2) cost is
+// paid once and amortizes to nothing; it would not be if routes were
+// registered continuously at request-serving volume.
+func (s *muxerState) publishLocked() {
+	table := newRoutingTable()
+	table.apply(s.registrations)
+	table.middlewares = s.middlewareFns
+	table.notFoundHandler = s.notFoundFn
+	s.table.Store(table)
 }
 
 // split splits the pattern, separating it into host and path.
@@ -225,16 +181,93 @@ func (m *Muxer) HandleFunc(pattern string, handler func(http.ResponseWriter, *ht
 	m.Handle(pattern, nil, methods...)
 }
 
+// Use appends middlewares to the Muxer's global chain. Every request
+// that reaches a matched handler passes through the chain first, in
+// the order given, regardless of whether the route was registered
+// directly on the Muxer or through a Group.
+func (m *Muxer) Use(mw ...func(http.Handler) http.Handler) {
+	s := m.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.middlewareFns = append(s.middlewareFns, mw...)
+	s.publishLocked()
+}
+
+// Host returns a Muxer that registers routes scoped to host, so that
+// repeated calls don't need to repeat the host prefix. Host supports
+// the same ":name" and "*" dynamic labels as a host prefix passed
+// directly to Handle. The returned Muxer shares the parent's routing
+// table and global middleware chain, so dispatching a request to it
+// behaves exactly like dispatching it to the parent, host matching
+// included.
+func (m *Muxer) Host(host string) *Muxer {
+	return &Muxer{state: m.state, hostPrefix: strings.ToLower(host)}
+}
+
+// Group returns a sub-router that registers routes under prefix and
+// applies its own middleware chain to them, leaving the Muxer's global
+// chain and other groups untouched. Prefix is joined with the patterns
+// passed to the returned Group's Handle/HandleFunc, so a Group with
+// prefix "/api" registering "/users" ends up handling "/api/users".
+func (m *Muxer) Group(prefix string) *Group {
+	return &Group{mux: m, prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// Group is a sub-router sharing its parent Muxer's routing tree, used
+// to apply a middleware chain to a subset of routes without pulling in
+// a second router.
+type Group struct {
+	mux         *Muxer
+	prefix      string
+	middlewares []func(http.Handler) http.Handler
+}
+
+// Use appends middlewares to the Group's chain. They run only for
+// routes registered through this Group, wrapping the handler before
+// the Muxer's global chain does.
+func (g *Group) Use(mw ...func(http.Handler) http.Handler) {
+	g.middlewares = append(g.middlewares, mw...)
+}
+
+// Handle registers the handler for prefix+pattern on the parent Muxer,
+// wrapped with the Group's middleware chain. See Muxer.Handle for
+// details on patterns and methods.
+func (g *Group) Handle(pattern string, handler http.Handler, methods ...string) {
+	if handler != nil {
+		handler = chain(g.middlewares, handler)
+	}
+	g.mux.Handle(g.prefix+pattern, handler, methods...)
+}
+
+// HandleFunc registers the handler function for prefix+pattern.
+// See the Handle method for details.
+func (g *Group) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request), methods ...string) {
+	if handler != nil {
+		g.Handle(pattern, http.HandlerFunc(handler), methods...)
+		return
+	}
+	g.Handle(pattern, nil, methods...)
+}
+
+// chain wraps handler with mw, so that mw[0] runs first.
+func chain(mw []func(http.Handler) http.Handler, handler http.Handler) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+	return handler
+}
+
 // ServeHTTP dispatches the request to the handler whose
 // pattern most closely matches the request URL.
 //
 // If the path is not in its canonical form, the
 // handler will be an internally-generated handler
 // that redirects to the canonical path.
+//
+// ServeHTTP reads the Muxer's routing table with a single atomic load
+// and never blocks on a lock, regardless of how many other goroutines
+// are concurrently calling Handle, Use or NotFound.
 func (m *Muxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
 	if r.RequestURI == "*" {
 		if r.ProtoAtLeast(1, 1) {
 			w.Header().Set("Connection", "close")
@@ -252,30 +285,57 @@ func (m *Muxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	h, args, methodMismatch := m.match(r.Method, r.Host, r.URL.Path)
-	if h != nil {
-		if len(args) > 0 {
-			ctx := r.Context()
-			for key, value := range args {
-				ctx = context.WithValue(ctx, CtxKey(key), value)
-			}
-			r = r.WithContext(ctx)
-		}
-		h.ServeHTTP(w, r)
+	table := m.state.table.Load()
+	h, args, methodMismatch, allowed := table.match(r.Method, r.Host, r.URL.Path)
+	switch {
+	case h != nil:
+		// matched, h is used as is below
+	case r.Method == http.MethodOptions && methodMismatch:
+		h = optionsHandler(allowed)
+	case table.notFoundHandler != nil:
+		table.notFoundHandler(w, r, methodMismatch)
 		return
+	default:
+		h = notFoundHandler(methodMismatch, allowed)
 	}
 
-	if m.notFoundHandler != nil {
-		m.notFoundHandler(w, r, methodMismatch)
-		return
+	// Every response the Muxer generates itself, not just a matched
+	// route's handler, passes through the global middleware chain, so
+	// e.g. CORS can add its headers to an automatic OPTIONS/405 answer
+	// the same way it does to a real handler's response.
+	if len(args) > 0 {
+		ctx := r.Context()
+		for key, value := range args {
+			ctx = context.WithValue(ctx, CtxKey(key), value)
+		}
+		r = r.WithContext(ctx)
 	}
+	chain(table.middlewares, h).ServeHTTP(w, r)
+}
 
-	status := http.StatusNotFound
-	if methodMismatch {
-		status = http.StatusMethodNotAllowed
-	}
-	text := http.StatusText(status)
-	http.Error(w, text, status)
+// optionsHandler answers an automatic OPTIONS request for a path that
+// matched but not for the request's method, listing allowed in the
+// Allow header.
+func optionsHandler(allowed []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// notFoundHandler answers a request that matched no route with 404, or
+// 405 with an Allow header if methodMismatch is true.
+func notFoundHandler(methodMismatch bool, allowed []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusNotFound
+		if methodMismatch {
+			status = http.StatusMethodNotAllowed
+			if len(allowed) > 0 {
+				w.Header().Set("Allow", strings.Join(allowed, ", "))
+			}
+		}
+		http.Error(w, http.StatusText(status), status)
+	})
 }
 
 // Return the canonical path for p, eliminating . and .. elements.
@@ -295,58 +355,6 @@ func cleanPath(p string) string {
 	return np
 }
 
-func (m *Muxer) match(method, _, path string) (h http.Handler, args args, methodMismatch bool) {
-	endsInSlash := path[len(path)-1] == '/'
-	segments := strings.Split(strings.Trim(path, "/"), "/")
-	slen := len(segments)
-
-	candidates := m.possibleRoutes(slen, endsInSlash)
-	candLen := len(candidates)
-
-LOOP:
-	for i := slen - 1; i >= 0; i-- {
-		s := segments[i]
-
-		for k, r := range candidates {
-			if r != nil && r.notMatch(s, i) {
-				candidates[k] = nil
-				candLen -= 1
-			}
-		}
-		if candLen == 0 {
-			break LOOP
-		}
-	}
-
-	if candLen > 0 {
-		for _, c := range candidates {
-			if c != nil && c.methodSupported(method) {
-				args = c.argsMap(segments)
-				if c.len < slen || endsInSlash {
-					h = c.slashHandler
-				} else {
-					h = c.nonSlashHandler
-				}
-				return
-			}
-		}
-		methodMismatch = true
-	}
-	return
-}
-
-func (m *Muxer) possibleRoutes(slen int, endsInSlash bool) []*route {
-	routes := make([]*route, 0, len(m.routes))
-	for _, r := range m.routes {
-		if r.len == slen && ((endsInSlash && r.slashHandler != nil) || (!endsInSlash && r.nonSlashHandler != nil)) {
-			routes = append(routes, r)
-		} else if r.len < slen && r.slashHandler != nil {
-			routes = append(routes, r)
-		}
-	}
-	return routes
-}
-
 // NotFound registers a handler that will be called when
 // the Muxer didn't find a suitable handler for the request.
 // The handler can be used to reply to the request with a custom error.
@@ -358,9 +366,24 @@ func (m *Muxer) possibleRoutes(slen int, endsInSlash bool) []*route {
 // It can be used to distinguish between 404 Not Found and
 // 405 Method Not Allowed errors.
 func (m *Muxer) NotFound(h func(w http.ResponseWriter, r *http.Request, methodMismatch bool)) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.notFoundHandler = h
+	s := m.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notFoundFn = h
+	s.publishLocked()
+}
+
+// Walk calls fn once for every registered pattern that still has a
+// handler, passing its pattern, the HTTP methods it is restricted to
+// (nil if it answers any method), and its handler. A pattern
+// registered for several methods is reported once per method, with
+// methods holding that single method, even when the methods share one
+// handler. Walk stops and returns fn's error as soon as fn
+// returns one.
+//
+// The traversal order is unspecified.
+func (m *Muxer) Walk(fn func(pattern string, methods []string, h http.Handler) error) error {
+	return m.state.table.Load().walk(fn)
 }
 
 // CtxKey is the type of the context keys at which named parameter
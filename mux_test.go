@@ -1,10 +1,14 @@
 package mux
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -74,6 +78,77 @@ func TestDynamicPattern(t *testing.T) {
 	pr.assertEquals(t)
 }
 
+func TestRegexConstraint(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	m.HandleFunc(`/users/:id(\d+)`, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Context().Value(CtxKey("id")))
+	})
+	assertOK(t, m, "GET", "/users/42", "42")
+	assertNotFound(t, m, "GET", "/users/abc", 404)
+}
+
+func TestConflictingDynamicSegmentAtSamePositionPanics(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	m.HandleFunc("/users/:id", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Context().Value(CtxKey("id")))
+	}, "GET")
+
+	// Registering a differently-named, differently-constrained route at
+	// the same tree position must not silently corrupt the working
+	// "/users/:id" registration already in place; rejecting it outright
+	// is preferable to the alternative of "id" quietly starting to
+	// require digits-only because of an unrelated POST route.
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a conflicting dynamic segment to panic")
+		}
+	}()
+	m.HandleFunc(`/users/:slug([a-z]+)`, func(w http.ResponseWriter, r *http.Request) {}, "POST")
+}
+
+func TestTypedShortcuts(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	m.HandleFunc("/users/{id:int}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := r.Context().Value(CtxKey("id")).(int)
+		if !ok {
+			t.Fatalf("expected an int in the context, got %#v", r.Context().Value(CtxKey("id")))
+		}
+		fmt.Fprintf(w, "%d", id)
+	})
+	m.HandleFunc("/orders/{id:uuid}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := r.Context().Value(CtxKey("id")).(UUID)
+		if !ok {
+			t.Fatalf("expected a UUID in the context, got %#v", r.Context().Value(CtxKey("id")))
+		}
+		fmt.Fprint(w, id.String())
+	})
+	m.HandleFunc("/posts/{slug:[a-z0-9-]+}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Context().Value(CtxKey("slug")))
+	})
+
+	assertOK(t, m, "GET", "/users/42", "42")
+	assertNotFound(t, m, "GET", "/users/abc", 404)
+
+	uuid := "123e4567-e89b-12d3-a456-426614174000"
+	assertOK(t, m, "GET", "/orders/"+uuid, uuid)
+	assertNotFound(t, m, "GET", "/orders/not-a-uuid", 404)
+
+	assertOK(t, m, "GET", "/posts/hello-world", "hello-world")
+	assertNotFound(t, m, "GET", "/posts/Hello_World", 404)
+}
+
+func TestCatchAllShortcut(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	m.HandleFunc("/static/{path:*}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Context().Value(CtxKey("path")))
+	})
+	assertOK(t, m, "GET", "/static/css/site.css", "css/site.css")
+}
+
 func TestRegisterPatternTwice(t *testing.T) {
 	t.Parallel()
 	m := NewMuxer()
@@ -92,6 +167,16 @@ func TestRemoveHandler(t *testing.T) {
 	assertNotFound(t, m, "GET", "/new", 404)
 }
 
+func TestRemoveHandlerFallsThroughToShorterCatchAll(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	register(m, "/users/", nil, "Users", nil)
+	register(m, "/users/admin", nil, "Admin", nil)
+	assertOK(t, m, "GET", "/users/admin", "Admin")
+	m.Handle("/users/admin", nil)
+	assertOK(t, m, "GET", "/users/admin", "Users")
+}
+
 func TestHTTPMethods(t *testing.T) {
 	t.Parallel()
 	m := NewMuxer()
@@ -117,6 +202,248 @@ func TestHTTPMethods(t *testing.T) {
 	assertNotFound(t, m, "DELETE", "/car", 405)
 }
 
+func TestHostScopedPattern(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	m.HandleFunc("api.example.com/users", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "API users")
+	})
+	register(m, "/users", nil, "Default users", nil)
+
+	assertHostOK(t, m, "GET", "api.example.com", "/users", "API users")
+	assertHostOK(t, m, "GET", "other.example.com", "/users", "Default users")
+}
+
+func TestHostDynamicLabel(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	m.HandleFunc(":tenant.example.com/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Context().Value(CtxKey("tenant")))
+	})
+
+	assertHostOK(t, m, "GET", "acme.example.com", "/dashboard", "acme")
+	assertHostNotFound(t, m, "GET", "example.com", "/dashboard", 404)
+}
+
+func TestHostWildcardLabel(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	m.HandleFunc("*.example.com/status", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Status")
+	})
+
+	assertHostOK(t, m, "GET", "anything.example.com", "/status", "Status")
+	assertHostNotFound(t, m, "GET", "example.com", "/status", 404)
+}
+
+func TestHostWildcardDoesNotClobberADynamicLabelAtTheSamePosition(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	m.HandleFunc(":tenant.example.com/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Context().Value(CtxKey("tenant")))
+	})
+	m.HandleFunc("*.example.com/other", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Other")
+	})
+
+	assertHostOK(t, m, "GET", "acme.example.com", "/dashboard", "acme")
+	assertHostOK(t, m, "GET", "anything.example.com", "/other", "Other")
+}
+
+func TestHostMethod(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	api := m.Host("api.example.com")
+	api.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Orders")
+	})
+
+	assertHostOK(t, m, "GET", "api.example.com", "/orders", "Orders")
+	assertHostNotFound(t, m, "GET", "other.example.com", "/orders", 404)
+}
+
+func TestWalk(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	register(m, "/users/", []string{"GET"}, "Users", nil)
+	register(m, "/users/:id", []string{"GET", "POST"}, "User", nil)
+	m.Host("api.example.com").HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {})
+	m.Handle("/removed", nil)
+
+	seen := map[string][]string{}
+	if err := m.Walk(func(pattern string, methods []string, h http.Handler) error {
+		seen[pattern] = append(seen[pattern], methods...)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := seen["/users/"]; !ok {
+		t.Fatalf("expected /users/ to be walked, got %v", seen)
+	}
+	if len(seen["/users/:id"]) != 2 {
+		t.Fatalf("expected 2 methods for /users/:id, got %v", seen["/users/:id"])
+	}
+	if _, ok := seen["api.example.com/status"]; !ok {
+		t.Fatalf("expected the host-scoped pattern to be walked, got %v", seen)
+	}
+	if _, ok := seen["/removed"]; ok {
+		t.Fatalf("expected the removed pattern to be skipped, got %v", seen)
+	}
+}
+
+func TestWalkStopsOnError(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	register(m, "/a", nil, "A", nil)
+	register(m, "/b", nil, "B", nil)
+
+	boom := errors.New("boom")
+	calls := 0
+	err := m.Walk(func(pattern string, methods []string, h http.Handler) error {
+		calls++
+		return boom
+	})
+	if err != boom {
+		t.Fatalf("expected Walk to return the callback's error, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected Walk to stop after the first error, got %d calls", calls)
+	}
+}
+
+func TestAutomaticOptions(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	register(m, "/gift", []string{"GET", "POST"}, "Gift", nil)
+
+	rec := serve(t, m, "OPTIONS", "/gift")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	assertAllowHeader(t, rec, "GET", "POST")
+}
+
+func TestAutomaticOptionsPassesThroughCORSMiddleware(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	m.Use(CORS("https://example.com"))
+	register(m, "/gift", []string{"GET", "POST"}, "Gift", nil)
+
+	req := httptest.NewRequest("OPTIONS", "/gift", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Fatalf("expected Access-Control-Allow-Origin header, got %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "POST" {
+		t.Fatalf("expected Access-Control-Allow-Methods header, got %q", got)
+	}
+}
+
+func TestAllowHeaderOnMethodNotAllowed(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	register(m, "/gift", []string{"GET", "POST"}, "Gift", nil)
+
+	rec := serve(t, m, "DELETE", "/gift")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rec.Code)
+	}
+	assertAllowHeader(t, rec, "GET", "POST")
+}
+
+func assertAllowHeader(t *testing.T, rec *httptest.ResponseRecorder, want ...string) {
+	got := strings.Split(rec.Header().Get("Allow"), ", ")
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("expected Allow header %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected Allow header %v, got %v", want, got)
+		}
+	}
+}
+
+func TestConcurrentHandleAndServeHTTP(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	register(m, "/stable", nil, "Stable", nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(t, m, "GET", "/stable")
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.HandleFunc(fmt.Sprintf("/added/%d", i), func(w http.ResponseWriter, r *http.Request) {})
+		}(i)
+	}
+	wg.Wait()
+
+	assertOK(t, m, "GET", "/stable", "Stable")
+	for i := 0; i < 20; i++ {
+		assertOK(t, m, "GET", fmt.Sprintf("/added/%d", i), "")
+	}
+}
+
+func TestUseWrapsMatchedHandler(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	var order []string
+	m.Use(trackingMiddleware(&order, "outer"), trackingMiddleware(&order, "inner"))
+	register(m, "/home", nil, "Home", nil)
+
+	assertOK(t, m, "GET", "/home", "Home")
+	if len(order) != 2 || order[0] != "outer" || order[1] != "inner" {
+		t.Fatalf("expected middlewares to run outer before inner, got %v", order)
+	}
+}
+
+func TestGroupMiddlewareIsScopedToTheGroup(t *testing.T) {
+	t.Parallel()
+	m := NewMuxer()
+	register(m, "/home", nil, "Home", nil)
+
+	var order []string
+	g := m.Group("/admin")
+	g.Use(trackingMiddleware(&order, "admin"))
+	g.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Dashboard")
+	})
+
+	assertOK(t, m, "GET", "/admin/dashboard", "Dashboard")
+	if len(order) != 1 || order[0] != "admin" {
+		t.Fatalf("expected the group middleware to run, got %v", order)
+	}
+
+	order = nil
+	assertOK(t, m, "GET", "/home", "Home")
+	if len(order) != 0 {
+		t.Fatalf("expected the group middleware to be scoped to the group, got %v", order)
+	}
+}
+
+func trackingMiddleware(order *[]string, name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*order = append(*order, name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func register(m *Muxer, pattern string, methods []string, body string, cr *paramsRecorder) {
 	handlerFunc := func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, body)
@@ -163,6 +490,40 @@ func serve(t *testing.T, m *Muxer, method, path string) *httptest.ResponseRecord
 	return w
 }
 
+func assertHostOK(t *testing.T, m *Muxer, method, host, path, body string) {
+	rec := serveHost(m, method, host, path)
+
+	if rec.Code != http.StatusOK {
+		_, _, line, _ := runtime.Caller(1)
+		t.Fatalf("expected code %d, but got: %d (line %d)",
+			http.StatusOK, rec.Code, line)
+	}
+
+	if rec.Body.String() != body {
+		_, _, line, _ := runtime.Caller(1)
+		t.Fatalf("expected body '%s', but got: '%s' (line %d)",
+			body, rec.Body.String(), line)
+	}
+}
+
+func assertHostNotFound(t *testing.T, m *Muxer, method, host, path string, status int) {
+	rec := serveHost(m, method, host, path)
+
+	if rec.Code != status {
+		_, _, line, _ := runtime.Caller(1)
+		t.Fatalf("expected status %d, but got: %d (line %d)",
+			status, rec.Code, line)
+	}
+}
+
+func serveHost(m *Muxer, method, host, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, nil)
+	r.Host = host
+	m.ServeHTTP(w, r)
+	return w
+}
+
 type paramsRecorder struct {
 	expected args
 	actual   args
@@ -0,0 +1,104 @@
+// Copyright 2017 Péter Szakszon. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mux
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/szxp/mux/internal/tree"
+)
+
+// shortcut describes a named type shortcut usable in a "{name:type}"
+// pattern segment, such as "{id:int}".
+type shortcut struct {
+	regex   *regexp.Regexp
+	convert tree.Convert
+}
+
+var shortcuts = map[string]shortcut{
+	"int": {
+		regex: regexp.MustCompile(`^-?\d+$`),
+		convert: func(s string) (interface{}, error) {
+			return strconv.Atoi(s)
+		},
+	},
+	"uuid": {
+		regex: regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`),
+		convert: func(s string) (interface{}, error) {
+			return parseUUID(s)
+		},
+	},
+}
+
+// parseSegments splits a trimmed pattern path into tree.Segments,
+// recognizing the ":name", ":name(regex)", "*name" and "{name:type}"
+// dynamic forms alongside plain static text. It panics if a pattern is
+// malformed, consistently with Handle's other pattern validation.
+func parseSegments(path string) []tree.Segment {
+	raw := strings.Split(path, "/")
+	segments := make([]tree.Segment, len(raw))
+	for i, s := range raw {
+		segments[i] = parseSegment(s)
+	}
+	return segments
+}
+
+func parseSegment(s string) tree.Segment {
+	switch {
+	case len(s) > 0 && s[0] == ':':
+		return parseColonSegment(s)
+	case len(s) > 0 && s[0] == '*':
+		return tree.Segment{Kind: tree.CatchAll, Text: s[1:]}
+	case len(s) > 1 && s[0] == '{' && s[len(s)-1] == '}':
+		return parseBraceSegment(s[1 : len(s)-1])
+	default:
+		return tree.Segment{Kind: tree.Static, Text: s}
+	}
+}
+
+// parseColonSegment handles ":name" and ":name(regex)".
+func parseColonSegment(s string) tree.Segment {
+	name := s[1:]
+	if open := strings.IndexByte(name, '('); open != -1 {
+		if name[len(name)-1] != ')' {
+			panic("invalid pattern segment " + s)
+		}
+		regex := name[open+1 : len(name)-1]
+		name = name[:open]
+		if name == "" || regex == "" {
+			panic("invalid pattern segment " + s)
+		}
+		return tree.Segment{Kind: tree.Dynamic, Text: name, Regex: anchor(regex)}
+	}
+	if name == "" {
+		panic("invalid pattern segment " + s)
+	}
+	return tree.Segment{Kind: tree.Dynamic, Text: name}
+}
+
+// parseBraceSegment handles the "name:type" content of a "{name:type}"
+// segment. Type "*" produces a catch-all; "int" and "uuid" are typed
+// shortcuts; anything else is used directly as a regex constraint.
+func parseBraceSegment(content string) tree.Segment {
+	name, typ, ok := strings.Cut(content, ":")
+	if !ok || name == "" || typ == "" {
+		panic("invalid pattern segment {" + content + "}")
+	}
+	if typ == "*" {
+		return tree.Segment{Kind: tree.CatchAll, Text: name}
+	}
+	if sc, ok := shortcuts[typ]; ok {
+		return tree.Segment{Kind: tree.Dynamic, Text: name, Regex: sc.regex, Convert: sc.convert}
+	}
+	return tree.Segment{Kind: tree.Dynamic, Text: name, Regex: anchor(typ)}
+}
+
+// anchor compiles regex, anchoring it so it must match a whole path
+// segment rather than just part of one.
+func anchor(regex string) *regexp.Regexp {
+	return regexp.MustCompile("^(?:" + regex + ")$")
+}
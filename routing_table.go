@@ -0,0 +1,287 @@
+// Copyright 2017 Péter Szakszon. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mux
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/szxp/mux/internal/tree"
+)
+
+// registration records one Handle call. A Muxer keeps every
+// registration it has ever received and replays them in order to
+// rebuild a routingTable from scratch whenever one changes, so a
+// routingTable never has to be mutated after it is published.
+type registration struct {
+	pattern string
+	handler http.Handler
+	methods []string
+}
+
+// routingTable is the immutable snapshot of a Muxer's routes that
+// ServeHTTP reads without locking. Handle, Use and NotFound each build
+// a fresh routingTable under the Muxer's writer lock and publish it
+// with a single atomic store, so a request in flight always sees
+// either the table from before the change or the table from after it,
+// never one partway through being rebuilt.
+type routingTable struct {
+	tree            *tree.Tree
+	hosts           *tree.Tree
+	middlewares     []func(http.Handler) http.Handler
+	notFoundHandler func(w http.ResponseWriter, r *http.Request, methodMismatch bool)
+}
+
+// newRoutingTable returns a routingTable with no routes registered.
+func newRoutingTable() *routingTable {
+	return &routingTable{tree: tree.New()}
+}
+
+// apply replays registrations into t's trees, in order.
+func (t *routingTable) apply(registrations []registration) {
+	for _, reg := range registrations {
+		host, path := split(reg.pattern)
+		endsInSlash := path[len(path)-1] == '/'
+		path = strings.Trim(path, "/")
+
+		target := t.tree
+		if host != "" {
+			target = t.hostPathTree(host)
+		}
+		leaf := target.Insert(parseSegments(path))
+		if endsInSlash {
+			leaf.SlashPattern = reg.pattern
+		} else {
+			leaf.NonSlashPattern = reg.pattern
+		}
+		for _, method := range reg.methods {
+			if endsInSlash {
+				leaf.Slash[method] = reg.handler
+			} else {
+				leaf.NonSlash[method] = reg.handler
+			}
+		}
+	}
+}
+
+// hostPathTree returns the path tree for host, creating both its entry
+// in t.hosts and the tree itself on first use.
+func (t *routingTable) hostPathTree(host string) *tree.Tree {
+	if t.hosts == nil {
+		t.hosts = tree.New()
+	}
+	leaf := t.hosts.Insert(parseHostSegments(host))
+	pt, _ := leaf.NonSlash[""].(*tree.Tree)
+	if pt == nil {
+		pt = tree.New()
+		leaf.NonSlash[""] = pt
+	}
+	return pt
+}
+
+// hostMatch pairs a host pattern's path tree with the params its host
+// labels bound, e.g. {tenant: "acme"} for the host pattern
+// ":tenant.example.com".
+type hostMatch struct {
+	tree   *tree.Tree
+	params map[string]interface{}
+}
+
+// matchingHostTrees returns the path trees registered for hostHeader,
+// most specific host first, each paired with the params bound by its
+// host pattern (nil if the host pattern was purely static).
+func (t *routingTable) matchingHostTrees(hostHeader string) []hostMatch {
+	if t.hosts == nil || hostHeader == "" {
+		return nil
+	}
+	candidates := t.hosts.Lookup(hostLabels(hostHeader))
+	matches := make([]hostMatch, 0, len(candidates))
+	for _, c := range candidates {
+		pt, ok := c.Leaf.NonSlash[""].(*tree.Tree)
+		if !ok {
+			continue
+		}
+		delete(c.Params, "")
+		matches = append(matches, hostMatch{tree: pt, params: c.Params})
+	}
+	return matches
+}
+
+func (t *routingTable) match(method, host, path string) (h http.Handler, args args, methodMismatch bool, allowed []string) {
+	endsInSlash := path[len(path)-1] == '/'
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	sawCandidate := false
+	for _, hm := range t.matchingHostTrees(host) {
+		hh, ha, mm, al := matchInTree(hm.tree, method, segments, endsInSlash)
+		if hh != nil {
+			return hh, mergeArgs(hm.params, ha), false, nil
+		}
+		if mm && !sawCandidate {
+			allowed = al
+		}
+		sawCandidate = sawCandidate || mm
+	}
+
+	hh, ha, mm, al := matchInTree(t.tree, method, segments, endsInSlash)
+	if hh != nil {
+		return hh, ha, false, nil
+	}
+	if mm && !sawCandidate {
+		allowed = al
+	}
+	methodMismatch = sawCandidate || mm
+	return
+}
+
+// matchInTree finds the handler registered in t for the given path
+// segments and method, following the same priority and 404/405 rules
+// as routingTable.match. When methodMismatch is true, allowed holds the
+// methods registered for the path that was found, for the Allow
+// header.
+func matchInTree(t *tree.Tree, method string, segments []string, endsInSlash bool) (h http.Handler, args args, methodMismatch bool, allowed []string) {
+	candidates := t.Lookup(segments)
+
+	sawCandidate := false
+	for _, c := range candidates {
+		required := c.Leaf.NonSlash
+		if c.Prefix || endsInSlash {
+			required = c.Leaf.Slash
+		}
+		if len(required) == 0 {
+			continue
+		}
+
+		handler, ok := lookupHandler(required, method)
+		if ok {
+			args = c.Params
+			h = handler
+			return
+		}
+
+		// required held no live handler for method, but it may still
+		// have live handlers for other methods (a real 405) or none at
+		// all (every handler registered for this path was removed via
+		// Handle(pattern, nil), so it shouldn't count as a candidate
+		// and lower-priority candidates get a chance to match).
+		live := methodKeys(required)
+		if len(live) == 0 {
+			continue
+		}
+		if !sawCandidate {
+			allowed = live
+		}
+		sawCandidate = true
+	}
+
+	methodMismatch = sawCandidate
+	return
+}
+
+// lookupHandler returns the handler registered in required for method,
+// falling back to the "any method" ("") entry, same priority as
+// matchInTree's exported behavior. A handler removed via Handle(pattern,
+// nil) leaves a nil value behind rather than deleting the map entry, so
+// a nil value is treated the same as "not present": the caller must
+// keep scanning lower-priority candidates instead of dispatching to a
+// handler that no longer exists.
+func lookupHandler(required map[string]interface{}, method string) (http.Handler, bool) {
+	if v, ok := required[method]; ok {
+		if h, _ := v.(http.Handler); h != nil {
+			return h, true
+		}
+	}
+	if v, ok := required[""]; ok {
+		if h, _ := v.(http.Handler); h != nil {
+			return h, true
+		}
+	}
+	return nil, false
+}
+
+// methodKeys returns the non-empty method keys of m that still have a
+// live handler, sorted for a stable Allow header.
+func methodKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k, v := range m {
+		if k == "" {
+			continue
+		}
+		if h, _ := v.(http.Handler); h == nil {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeArgs combines host params with path args into a single args
+// map. The two never share keys in practice, since host and path
+// parameters are named independently.
+func mergeArgs(hostParams map[string]interface{}, pathArgs args) args {
+	if len(hostParams) == 0 {
+		return pathArgs
+	}
+	merged := make(args, len(hostParams)+len(pathArgs))
+	for k, v := range hostParams {
+		merged[k] = v
+	}
+	for k, v := range pathArgs {
+		merged[k] = v
+	}
+	return merged
+}
+
+// walk calls fn for every leaf reachable from t, including leaves
+// nested inside per-host trees, stopping early if fn returns a
+// non-nil error.
+func (t *routingTable) walk(fn func(pattern string, methods []string, h http.Handler) error) error {
+	var err error
+	visit := func(leaf *tree.Leaf) bool {
+		err = walkVariant(leaf.NonSlashPattern, leaf.NonSlash, fn)
+		if err == nil {
+			err = walkVariant(leaf.SlashPattern, leaf.Slash, fn)
+		}
+		return err == nil
+	}
+
+	t.tree.Walk(visit)
+	if err == nil && t.hosts != nil {
+		t.hosts.Walk(func(hostLeaf *tree.Leaf) bool {
+			pt, ok := hostLeaf.NonSlash[""].(*tree.Tree)
+			if !ok {
+				return true
+			}
+			pt.Walk(visit)
+			return err == nil
+		})
+	}
+	return err
+}
+
+// walkVariant calls fn for every handler registered in handlers,
+// skipping removed (nil) handlers. A "" method key, meaning any
+// method, is reported with a nil methods slice.
+func walkVariant(pattern string, handlers map[string]interface{}, fn func(string, []string, http.Handler) error) error {
+	if pattern == "" {
+		return nil
+	}
+	for method, v := range handlers {
+		handler, ok := v.(http.Handler)
+		if !ok || handler == nil {
+			continue
+		}
+		var methods []string
+		if method != "" {
+			methods = []string{method}
+		}
+		if err := fn(pattern, methods, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
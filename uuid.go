@@ -0,0 +1,46 @@
+// Copyright 2017 Péter Szakszon. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mux
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// UUID is a parsed universally unique identifier, bound into the
+// request context by the {name:uuid} pattern shortcut instead of the
+// raw string.
+type UUID [16]byte
+
+// String returns the canonical 8-4-4-4-12 hyphenated representation.
+func (u UUID) String() string {
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:36], u[10:16])
+	return string(buf)
+}
+
+// parseUUID parses the canonical hyphenated form of s into a UUID.
+func parseUUID(s string) (UUID, error) {
+	var u UUID
+	s = strings.ReplaceAll(s, "-", "")
+	if len(s) != 32 {
+		return u, fmt.Errorf("mux: invalid uuid %q", s)
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return u, fmt.Errorf("mux: invalid uuid %q: %w", s, err)
+	}
+	copy(u[:], b)
+	return u, nil
+}